@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Account describes what a successfully authenticated user is allowed to
+// do: where their tree is rooted and whether they may write to it or how
+// fast.
+type Account struct {
+	HomeDir           string
+	ReadOnly          bool
+	UploadRatelimit   int64 // bytes/sec, 0 means unlimited
+	DownloadRatelimit int64 // bytes/sec, 0 means unlimited
+}
+
+// Authenticator turns USER/PASS credentials into an Account, or rejects
+// them.
+type Authenticator interface {
+	Authenticate(user, pass string) (*Account, error)
+}
+
+// ErrAuthentication is returned by an Authenticator when the credentials
+// it was given don't check out.
+var ErrAuthentication = errors.New("authentication failed")
+
+// AnonymousAuthenticator reproduces this server's original behavior:
+// every USER/PASS pair succeeds. It must be selected explicitly at
+// startup (-auth=anonymous) rather than being the implicit default.
+type AnonymousAuthenticator struct {
+	home string
+}
+
+// NewAnonymousAuthenticator returns an Authenticator that accepts any
+// credentials and roots every session at home.
+func NewAnonymousAuthenticator(home string) *AnonymousAuthenticator {
+	return &AnonymousAuthenticator{home: home}
+}
+
+func (a *AnonymousAuthenticator) Authenticate(user, pass string) (*Account, error) {
+	return &Account{HomeDir: a.home}, nil
+}
+
+// HtpasswdAuthenticator checks credentials against a flat file of
+// "user:{SHA}base64(sha1(password))" lines, the format Apache's htpasswd
+// -s flag produces. Only the {SHA} scheme is supported: bcrypt and apr1
+// require a hashing library this module doesn't vendor. Every user is
+// chrooted to a subdirectory of baseHome named after their username.
+type HtpasswdAuthenticator struct {
+	baseHome string
+	hashes   map[string]string // user -> "{SHA}......" as read from the file
+}
+
+// NewHtpasswdAuthenticator loads path and chroots each authenticated user
+// to filepath.Join(baseHome, user).
+func NewHtpasswdAuthenticator(path, baseHome string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		hashes[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &HtpasswdAuthenticator{baseHome: baseHome, hashes: hashes}, nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(user, pass string) (*Account, error) {
+	hash, ok := a.hashes[user]
+	if !ok {
+		return nil, ErrAuthentication
+	}
+
+	if !strings.HasPrefix(hash, "{SHA}") {
+		return nil, errors.New("htpasswd: unsupported hash scheme (only {SHA} is supported)")
+	}
+
+	sum := sha1.Sum([]byte(pass))
+	if base64.StdEncoding.EncodeToString(sum[:]) != strings.TrimPrefix(hash, "{SHA}") {
+		return nil, ErrAuthentication
+	}
+
+	return &Account{HomeDir: filepath.Join(a.baseHome, user)}, nil
+}
+
+// JSONAuthenticator checks credentials against a JSON file mapping
+// usernames to their full account configuration, including per-user home
+// directory, read-only flag and transfer rate limits.
+type JSONAuthenticator struct {
+	accounts map[string]jsonAccount
+}
+
+type jsonAccount struct {
+	Password          string `json:"password"`
+	HomeDir           string `json:"home_dir"`
+	ReadOnly          bool   `json:"read_only"`
+	UploadRatelimit   int64  `json:"upload_ratelimit"`
+	DownloadRatelimit int64  `json:"download_ratelimit"`
+}
+
+// NewJSONAuthenticator loads path, a JSON object of the form
+// {"alice": {"password": "...", "home_dir": "...", "read_only": false}}.
+func NewJSONAuthenticator(path string) (*JSONAuthenticator, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts map[string]jsonAccount
+	if err := json.Unmarshal(dat, &accounts); err != nil {
+		return nil, err
+	}
+
+	return &JSONAuthenticator{accounts: accounts}, nil
+}
+
+func (a *JSONAuthenticator) Authenticate(user, pass string) (*Account, error) {
+	account, ok := a.accounts[user]
+	if !ok || account.Password != pass {
+		return nil, ErrAuthentication
+	}
+
+	return &Account{
+		HomeDir:           account.HomeDir,
+		ReadOnly:          account.ReadOnly,
+		UploadRatelimit:   account.UploadRatelimit,
+		DownloadRatelimit: account.DownloadRatelimit,
+	}, nil
+}
+
+// handleUser implements USER, stashing the username until PASS arrives to
+// complete the login.
+func (s *session) handleUser(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "USER"))
+		return
+	}
+
+	s.pendingUser = arg[1]
+	s.handleResponse(fmt.Sprintf(UserOkayNeedPassword, s.pendingUser))
+}
+
+// handlePass implements PASS, authenticating the USER/PASS pair against
+// s.authenticator and, on success, chrooting the session to the resulting
+// Account's HomeDir and applying its rate limits.
+func (s *session) handlePass(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASS"))
+		return
+	}
+
+	account, err := s.authenticator.Authenticate(s.pendingUser, arg[1])
+	if err != nil {
+		s.handleResponse(LoginIncorrect)
+		return
+	}
+
+	s.account = account
+	s.loggedIn = true
+	s.fs = NewDirFS(account.HomeDir)
+	s.cwd = "/"
+	s.uploadLimiter = newRateLimiter(account.UploadRatelimit)
+	s.downloadLimiter = newRateLimiter(account.DownloadRatelimit)
+
+	s.handleResponse(UserLoggedInProceed)
+}
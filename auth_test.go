@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAnonymousAuthenticatorAlwaysSucceeds(t *testing.T) {
+	a := NewAnonymousAuthenticator("/srv")
+
+	account, err := a.Authenticate("anyone", "anything")
+	if err != nil {
+		t.Fatalf("Authenticate() = %v, want nil error", err)
+	}
+	if account.HomeDir != "/srv" {
+		t.Fatalf("HomeDir = %q, want %q", account.HomeDir, "/srv")
+	}
+}
+
+func writeTempFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "auth-")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	return f.Name()
+}
+
+func TestHtpasswdAuthenticatorAcceptsMatchingShaHash(t *testing.T) {
+	// "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=" is the {SHA} hash of "secret".
+	path := writeTempFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	a, err := NewHtpasswdAuthenticator(path, "/srv")
+	if err != nil {
+		t.Fatalf("NewHtpasswdAuthenticator: %v", err)
+	}
+
+	account, err := a.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate() = %v, want nil error", err)
+	}
+	if want := "/srv/alice"; account.HomeDir != want {
+		t.Fatalf("HomeDir = %q, want %q", account.HomeDir, want)
+	}
+}
+
+func TestHtpasswdAuthenticatorRejectsWrongPassword(t *testing.T) {
+	path := writeTempFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	a, err := NewHtpasswdAuthenticator(path, "/srv")
+	if err != nil {
+		t.Fatalf("NewHtpasswdAuthenticator: %v", err)
+	}
+
+	if _, err := a.Authenticate("alice", "wrong"); err != ErrAuthentication {
+		t.Fatalf("Authenticate() = %v, want ErrAuthentication", err)
+	}
+}
+
+func TestJSONAuthenticatorAcceptsConfiguredAccount(t *testing.T) {
+	path := writeTempFile(t, `{"bob": {"password": "hunter2", "home_dir": "/srv/bob", "read_only": true}}`)
+
+	a, err := NewJSONAuthenticator(path)
+	if err != nil {
+		t.Fatalf("NewJSONAuthenticator: %v", err)
+	}
+
+	account, err := a.Authenticate("bob", "hunter2")
+	if err != nil {
+		t.Fatalf("Authenticate() = %v, want nil error", err)
+	}
+	if !account.ReadOnly {
+		t.Fatalf("ReadOnly = false, want true")
+	}
+}
+
+func TestJSONAuthenticatorRejectsUnknownUser(t *testing.T) {
+	path := writeTempFile(t, `{"bob": {"password": "hunter2"}}`)
+
+	a, err := NewJSONAuthenticator(path)
+	if err != nil {
+		t.Fatalf("NewJSONAuthenticator: %v", err)
+	}
+
+	if _, err := a.Authenticate("carol", "hunter2"); err != ErrAuthentication {
+		t.Fatalf("Authenticate() = %v, want ErrAuthentication", err)
+	}
+}
+
+func TestHandleConnRejectsMutatingCommandsBeforeLogin(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	go handleConn(s)
+
+	fmt.Fprintf(client, "STOR foo.txt\r\n")
+	assertResponse(t, client, NotLoggedIn)
+}
+
+func TestHandlePassChrootsToAccountHomeDir(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	home, err := ioutil.TempDir("", "home-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(home)
+
+	s.authenticator = NewAnonymousAuthenticator(home)
+	s.pendingUser = "anyone"
+
+	s.handlePass([]string{"PASS", "anything"})
+	assertResponse(t, client, UserLoggedInProceed)
+
+	if !s.loggedIn {
+		t.Fatalf("loggedIn = false, want true")
+	}
+	if _, ok := s.fs.(*DirFS); !ok {
+		t.Fatalf("fs = %T, want *DirFS", s.fs)
+	}
+}
+
+func TestHandlePassRejectsBadCredentials(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.authenticator = &JSONAuthenticator{accounts: map[string]jsonAccount{}}
+	s.pendingUser = "anyone"
+
+	s.handlePass([]string{"PASS", "anything"})
+	assertResponse(t, client, LoginIncorrect)
+
+	if s.loggedIn {
+		t.Fatalf("loggedIn = true, want false")
+	}
+}
+
+func TestHandleStoreRejectsReadOnlyAccount(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.account = &Account{ReadOnly: true}
+
+	s.handleStore([]string{"STOR", "file.txt"})
+	assertResponse(t, client, ReadOnlyAccount)
+}
+
+func TestRateLimiterThrottlesThroughput(t *testing.T) {
+	r := newRateLimiter(1024)
+
+	r.wait(1024) // drains the initial bucket without sleeping
+	r.tokens = 0 // force the next wait to observe a shortfall and sleep
+
+	r.wait(512)
+	if r.tokens < 0 {
+		t.Fatalf("tokens = %v, want >= 0 after wait", r.tokens)
+	}
+}
+
+func TestNewRateLimiterUnlimitedWhenZero(t *testing.T) {
+	if r := newRateLimiter(0); r != nil {
+		t.Fatalf("newRateLimiter(0) = %v, want nil", r)
+	}
+}
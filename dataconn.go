@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// openDataConn establishes the data connection for the command currently
+// being handled. In active mode (PORT/EPRT) it dials the address the
+// client gave us; in passive mode (PASV/EPSV) it accepts the connection
+// the client opens to s.pasv. When the client has requested PROT P, the
+// connection is wrapped in TLS before being handed to the caller so no
+// data-command handler can ever transfer cleartext by mistake.
+func (s *session) openDataConn() (net.Conn, error) {
+	conn, err := s.dialOrAccept()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.prot == "P" {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	s.mu.Lock()
+	s.dataConn = conn
+	s.mu.Unlock()
+
+	return conn, nil
+}
+
+// closeDataConn force-closes the session's active data connection, if any.
+// Shutdown calls this to unblock a handler stuck in io.Copy on a stalled
+// data socket once its caller's deadline has passed; cancelling ctx or
+// closing the control connection doesn't touch the data connection, so
+// without this the handler's goroutine (and Shutdown) would hang forever.
+func (s *session) closeDataConn() {
+	s.mu.Lock()
+	conn := s.dataConn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *session) dialOrAccept() (net.Conn, error) {
+	if s.dataAddr != nil {
+		return net.Dial(s.dataAddr.Network(), s.dataAddr.String())
+	}
+
+	if s.pasv == nil {
+		return nil, errors.New("no data connection configured; send PASV, EPSV, PORT or EPRT first")
+	}
+
+	return s.pasv.Accept()
+}
+
+// listenPassive opens a listener for passive/extended-passive mode on the
+// given network ("tcp4" or "tcp6"), honoring the configured passive port
+// range. A zero-width range (the default) lets the OS choose a free port;
+// otherwise every port in [pasvMinPort, pasvMaxPort] is tried in order so
+// admins behind NAT can pinhole a bounded range of ports.
+func (s *session) listenPassive(network string) (net.Listener, error) {
+	if s.pasvMinPort == 0 && s.pasvMaxPort == 0 {
+		return net.Listen(network, ":0")
+	}
+
+	var lastErr error
+	for port := s.pasvMinPort; port <= s.pasvMaxPort; port++ {
+		l, err := net.Listen(network, fmt.Sprintf(":%d", port))
+		if err == nil {
+			return l, nil
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("no free port in range %d-%d: %w", s.pasvMinPort, s.pasvMaxPort, lastErr)
+}
+
+// networkFor returns the dial/listen network ("tcp4" or "tcp6") matching
+// the address family of host.
+func networkFor(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// closePasv closes and clears any passive listener left over from a prior
+// PASV/EPSV, so switching modes (or issuing PASV twice) can't leak a
+// listener bound to a port in the configured range.
+func (s *session) closePasv() {
+	if s.pasv == nil {
+		return
+	}
+	s.pasv.Close()
+	s.pasv = nil
+}
+
+// validateDataHost reports whether host matches the IP the control
+// connection is actually talking to. PORT/EPRT let a client name an
+// arbitrary destination, and dialing it unchecked is the classic FTP
+// bounce attack (RFC 2577); we only ever dial back the client itself.
+func (s *session) validateDataHost(host string) bool {
+	remoteHost, _, err := net.SplitHostPort(s.sess.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	remote, want := net.ParseIP(remoteHost), net.ParseIP(host)
+	return remote != nil && want != nil && remote.Equal(want)
+}
+
+func (s *session) handlePassive() {
+	s.dataAddr = nil
+	s.closePasv()
+
+	h, _, err := net.SplitHostPort(s.sess.LocalAddr().String())
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	s.pasv, err = s.listenPassive(networkFor(h))
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	_, p, err := net.SplitHostPort(s.pasv.Addr().String())
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	addr, err := net.ResolveIPAddr("", h)
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	port, err := strconv.ParseInt(p, 10, 64)
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		// PASV's address-port encoding has no room for IPv6; clients that
+		// negotiated an IPv6 control connection are expected to use EPSV.
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	location := fmt.Sprintf(
+		"%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port/256, port%256,
+	)
+
+	s.handleResponse(fmt.Sprintf(EnteringPassiveMode, location))
+}
+
+// handleExtendedPassive implements RFC 2428 EPSV, the address-family
+// agnostic counterpart of PASV that IPv6 clients rely on.
+func (s *session) handleExtendedPassive() {
+	s.dataAddr = nil
+	s.closePasv()
+
+	h, _, err := net.SplitHostPort(s.sess.LocalAddr().String())
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPSV"))
+		return
+	}
+
+	s.pasv, err = s.listenPassive(networkFor(h))
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPSV"))
+		return
+	}
+
+	_, p, err := net.SplitHostPort(s.pasv.Addr().String())
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPSV"))
+		return
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPSV"))
+		return
+	}
+
+	s.handleResponse(fmt.Sprintf(EnteringExtendedPassiveMode, port))
+}
+
+// handlePort implements classic active-mode PORT: "h1,h2,h3,h4,p1,p2".
+func (s *session) handlePort(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PORT"))
+		return
+	}
+
+	part := strings.Split(arg[1], ",")
+	if len(part) != 6 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PORT"))
+		return
+	}
+
+	ip := net.JoinHostPort(strings.Join(part[0:4], "."), "0")
+	host, _, _ := net.SplitHostPort(ip)
+	if net.ParseIP(host) == nil {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PORT"))
+		return
+	}
+
+	if !s.validateDataHost(host) {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PORT"))
+		return
+	}
+
+	p1, err1 := strconv.Atoi(part[4])
+	p2, err2 := strconv.Atoi(part[5])
+	if err1 != nil || err2 != nil {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PORT"))
+		return
+	}
+
+	port := p1*256 + p2
+	s.closePasv()
+	s.dataAddr = &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+
+	s.handleResponse(PortCommandSuccessful)
+}
+
+// handleExtendedPort implements RFC 2428 EPRT: "|proto|addr|port|", where
+// proto is 1 for IPv4 or 2 for IPv6.
+func (s *session) handleExtendedPort(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	raw := arg[1]
+	if len(raw) < 5 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	delim := string(raw[0])
+	part := strings.Split(strings.Trim(raw, delim), delim)
+	if len(part) != 3 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	proto, host, portStr := part[0], part[1], part[2]
+	if proto != "1" && proto != "2" {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	if !s.validateDataHost(host) {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "EPRT"))
+		return
+	}
+
+	s.closePasv()
+	s.dataAddr = &net.TCPAddr{IP: ip, Port: port}
+
+	s.handleResponse(PortCommandSuccessful)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// loopback returns a control "session" backed by a real TCP connection over
+// the given network ("tcp4" or "tcp6"), so LocalAddr()/RemoteAddr() reflect
+// the requested address family the way a real client connection would.
+func loopback(t *testing.T, network string) (*session, net.Conn, func()) {
+	t.Helper()
+
+	host := "127.0.0.1"
+	if network == "tcp6" {
+		host = "::1"
+	}
+
+	ln, err := net.Listen(network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("%s not available: %v", network, err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := net.Dial(network, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	sess := <-accepted
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &session{sess: sess, fs: NewMemFS(), cwd: "/", ctx: ctx, cancel: cancel, prot: "C"}
+	return s, client, func() {
+		cancel()
+		sess.Close()
+		client.Close()
+	}
+}
+
+func testPASV(t *testing.T, network string) {
+	s, client, cleanup := loopback(t, network)
+	defer cleanup()
+
+	s.handlePassive()
+
+	if network == "tcp6" {
+		// PASV's 4-octet address format can't carry an IPv6 address.
+		assertResponse(t, client, fmt.Sprintf(RequestedActionHasFailed, "PASV"))
+		return
+	}
+
+	if s.pasv == nil {
+		t.Fatal("expected a passive listener to be opened")
+	}
+	defer s.pasv.Close()
+
+	dataClient, err := net.Dial("tcp", s.pasv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial data conn: %v", err)
+	}
+	defer dataClient.Close()
+
+	conn, err := s.openDataConn()
+	if err != nil {
+		t.Fatalf("openDataConn: %v", err)
+	}
+	conn.Close()
+}
+
+func testEPSV(t *testing.T, network string) {
+	s, client, cleanup := loopback(t, network)
+	defer cleanup()
+
+	s.handleExtendedPassive()
+
+	if s.pasv == nil {
+		t.Fatal("expected a passive listener to be opened")
+	}
+	defer s.pasv.Close()
+
+	_ = client // response format checked in TestEPSVResponseFormat
+
+	dataClient, err := net.Dial(network, s.pasv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial data conn: %v", err)
+	}
+	defer dataClient.Close()
+
+	conn, err := s.openDataConn()
+	if err != nil {
+		t.Fatalf("openDataConn: %v", err)
+	}
+	conn.Close()
+}
+
+func testPORTAndEPRT(t *testing.T, network string, useExtended bool) {
+	s, _, cleanup := loopback(t, network)
+	defer cleanup()
+
+	host := "127.0.0.1"
+	if network == "tcp6" {
+		host = "::1"
+	}
+
+	ln, err := net.Listen(network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("%s not available: %v", network, err)
+	}
+	defer ln.Close()
+
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+
+	if useExtended {
+		proto := "1"
+		if network == "tcp6" {
+			proto = "2"
+		}
+		s.handleExtendedPort([]string{"EPRT", fmt.Sprintf("|%s|%s|%s|", proto, host, portStr)})
+	} else {
+		if network == "tcp6" {
+			t.Skip("classic PORT has no IPv6 encoding")
+		}
+		port := atoiMust(t, portStr)
+		p1, p2 := port/256, port%256
+		s.handlePort([]string{"PORT", fmt.Sprintf("127,0,0,1,%d,%d", p1, p2)})
+	}
+
+	if s.dataAddr == nil {
+		t.Fatal("expected dataAddr to be set for active mode")
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := s.openDataConn()
+	if err != nil {
+		t.Fatalf("openDataConn: %v", err)
+	}
+	defer conn.Close()
+
+	serverSide := <-accepted
+	serverSide.Close()
+}
+
+func atoiMust(t *testing.T, s string) int {
+	t.Helper()
+	var n int
+	if _, err := fmt.Sscanf(s, "%d", &n); err != nil {
+		t.Fatalf("parse port %q: %v", s, err)
+	}
+	return n
+}
+
+func assertResponse(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	buf := make([]byte, len(want))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(buf) != want {
+		t.Fatalf("response = %q, want %q", buf, want)
+	}
+}
+
+func TestPASV_IPv4(t *testing.T) { testPASV(t, "tcp4") }
+func TestPASV_IPv6(t *testing.T) { testPASV(t, "tcp6") }
+
+func TestEPSV_IPv4(t *testing.T) { testEPSV(t, "tcp4") }
+func TestEPSV_IPv6(t *testing.T) { testEPSV(t, "tcp6") }
+
+func TestPORT_IPv4(t *testing.T) { testPORTAndEPRT(t, "tcp4", false) }
+
+func TestEPRT_IPv4(t *testing.T) { testPORTAndEPRT(t, "tcp4", true) }
+func TestEPRT_IPv6(t *testing.T) { testPORTAndEPRT(t, "tcp6", true) }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirFS is a Filesystem rooted at a directory on the local disk. Every
+// virtual path is run through resolveWithinRoot before touching disk, so
+// neither ".." segments nor a symlink planted inside root that points
+// outside it can escape the jail.
+type DirFS struct {
+	root string
+}
+
+// NewDirFS returns a Filesystem rooted at root, which must already exist.
+func NewDirFS(root string) *DirFS {
+	return &DirFS{root: root}
+}
+
+// resolve turns a virtual path into a real one, failing with ErrEscape
+// if it would leave fs.root. On Linux this also asks the kernel to
+// verify the resolution via openat2(2) (RESOLVE_BENEATH) as a second,
+// independent check. It backs every method except OpenFile, which opens
+// the file beneath root directly via openat2 instead of resolving to a
+// string first.
+func (fs *DirFS) resolve(name string) (string, error) {
+	resolved, err := resolveWithinRoot(fs.root, name)
+	if err != nil {
+		return "", err
+	}
+	if err := openat2VerifyBeneath(fs.root, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+func (fs *DirFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	target, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(target, perm)
+}
+
+// OpenFile opens name for the actual transfer of file content (RETR/
+// STOR/APPE), so unlike the other methods it doesn't go through resolve:
+// on Linux, the fd openat2(2) hands back is the fd it reads or writes, so
+// there's no gap between validating the path and opening it. Only when
+// openat2 isn't available does it fall back to the portable resolve-then-
+// open the rest of DirFS uses.
+func (fs *DirFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if openat2Supported() {
+		rel := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+
+		f, err := openat2OpenBeneath(fs.root, rel, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ctxFile{f: f, ctx: ctx}, nil
+	}
+
+	target, err := resolveWithinRoot(fs.root, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(target, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctxFile{f: f, ctx: ctx}, nil
+}
+
+func (fs *DirFS) RemoveAll(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	target, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(target)
+}
+
+func (fs *DirFS) Rename(ctx context.Context, oldname, newname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	oldTarget, err := fs.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	newTarget, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldTarget, newTarget)
+}
+
+func (fs *DirFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	target, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(target)
+}
+
+func (fs *DirFS) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	target, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(target)
+}
+
+// ctxFile wraps an *os.File so reads and writes fail fast once ctx is
+// done, instead of blocking a slow transfer past its deadline.
+type ctxFile struct {
+	f   *os.File
+	ctx context.Context
+}
+
+func (c *ctxFile) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.f.Read(p)
+}
+
+func (c *ctxFile) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.f.Write(p)
+}
+
+func (c *ctxFile) Seek(offset int64, whence int) (int64, error) {
+	return c.f.Seek(offset, whence)
+}
+
+func (c *ctxFile) Close() error {
+	return c.f.Close()
+}
+
+func (c *ctxFile) Stat() (os.FileInfo, error) {
+	return c.f.Stat()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// File is the subset of *os.File the handlers need: enough to read, write,
+// seek (for REST-style resume) and stat a file, regardless of which
+// Filesystem backend opened it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	io.Seeker
+	Stat() (os.FileInfo, error)
+}
+
+// Filesystem abstracts the directory tree a session operates on. Every
+// method takes a context so cancellations and deadlines (e.g. a client
+// disconnecting mid-transfer) propagate into long-running operations, and
+// every path is virtual and rooted at "/" regardless of backend; it is up
+// to the implementation to keep a client from addressing anything outside
+// its own root.
+type Filesystem interface {
+	Mkdir(ctx context.Context, name string, perm os.FileMode) error
+	OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error)
+	RemoveAll(ctx context.Context, name string) error
+	Rename(ctx context.Context, oldname, newname string) error
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+	ReadDir(ctx context.Context, name string) ([]os.FileInfo, error)
+}
+
+// virtualJoin resolves rel against cwd the way a shell would: an absolute
+// rel replaces cwd entirely, a relative one is appended to it. The result
+// is always a clean, "/"-rooted virtual path for a Filesystem method.
+func virtualJoin(cwd, rel string) string {
+	if strings.HasPrefix(rel, "/") {
+		return path.Clean(rel)
+	}
+	return path.Clean(path.Join(cwd, rel))
+}
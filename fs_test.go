@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestMemFSMkdirAndStat(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+
+	if err := fs.Mkdir(ctx, "/sub", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	info, err := fs.Stat(ctx, "/sub")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !info.IsDir() {
+		t.Fatal("expected /sub to be a directory")
+	}
+
+	if err := fs.Mkdir(ctx, "/sub", 0755); !os.IsExist(err) {
+		t.Fatalf("Mkdir on existing dir: err = %v, want os.ErrExist", err)
+	}
+}
+
+func TestMemFSWriteReadRoundTrip(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+
+	w, err := fs.OpenFile(ctx, "/hello.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile (write): %v", err)
+	}
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Close()
+
+	r, err := fs.OpenFile(ctx, "/hello.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile (read): %v", err)
+	}
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("content = %q, want %q", got, "hello world")
+	}
+}
+
+func TestMemFSOpenMissingWithoutCreateFails(t *testing.T) {
+	fs := NewMemFS()
+	if _, err := fs.OpenFile(context.Background(), "/missing.txt", os.O_RDONLY, 0); !os.IsNotExist(err) {
+		t.Fatalf("err = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestMemFSReadDir(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+
+	fs.Mkdir(ctx, "/dir", 0755)
+	w, _ := fs.OpenFile(ctx, "/dir/a.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	w.Close()
+	w, _ = fs.OpenFile(ctx, "/dir/b.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	w.Close()
+
+	infos, err := fs.ReadDir(ctx, "/dir")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "a.txt" || infos[1].Name() != "b.txt" {
+		t.Fatalf("ReadDir = %v, want [a.txt b.txt]", infos)
+	}
+}
+
+func TestMemFSRename(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+
+	w, _ := fs.OpenFile(ctx, "/old.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	w.Write([]byte("data"))
+	w.Close()
+
+	if err := fs.Rename(ctx, "/old.txt", "/new.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if _, err := fs.Stat(ctx, "/old.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected /old.txt to be gone, got err = %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/new.txt"); err != nil {
+		t.Fatalf("expected /new.txt to exist: %v", err)
+	}
+}
+
+func TestMemFSCancelledContext(t *testing.T) {
+	fs := NewMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := fs.Stat(ctx, "/"); err != context.Canceled {
+		t.Fatalf("Stat with cancelled ctx: err = %v, want context.Canceled", err)
+	}
+}
+
+// TestHandleStoreAndRetrieveOverMemFS exercises STOR followed by RETR
+// through the full server/handler path, backed by an in-memory
+// filesystem, without touching the real disk.
+func TestHandleStoreAndRetrieveOverMemFS(t *testing.T) {
+	s, _, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	s.pasv = ln
+
+	dataDone := make(chan struct{})
+	go func() {
+		defer close(dataDone)
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "payload")
+	}()
+
+	s.handleStore([]string{"STOR", "greeting.txt"})
+	<-dataDone
+
+	info, err := s.fs.Stat(s.ctx, "/greeting.txt")
+	if err != nil {
+		t.Fatalf("Stat after STOR: %v", err)
+	}
+	if info.Size() != int64(len("payload")) {
+		t.Fatalf("size = %d, want %d", info.Size(), len("payload"))
+	}
+
+	ln2, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln2.Close()
+	s.pasv = ln2
+
+	retrieved := make(chan string, 1)
+	go func() {
+		conn, err := net.Dial("tcp4", ln2.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		retrieved <- string(buf)
+	}()
+
+	s.handleRetrieve([]string{"RETR", "greeting.txt"})
+
+	if got := <-retrieved; got != "payload" {
+		t.Fatalf("retrieved = %q, want %q", got, "payload")
+	}
+}
+
+func TestHandleChangeWorkingDirectoryOverMemFS(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.fs.(*MemFS).Mkdir(s.ctx, "/sub", 0755)
+
+	s.handleChangeWorkingDirectory([]string{"CWD", "sub"})
+	assertResponse(t, client, fmt.Sprintf(RequestedFileActionCompleted, "/sub"))
+
+	if s.cwd != "/sub" {
+		t.Fatalf("cwd = %q, want /sub", s.cwd)
+	}
+}
+
+func TestHandleChangeWorkingDirectoryMissingFails(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.handleChangeWorkingDirectory([]string{"CWD", "nope"})
+	assertResponse(t, client, fmt.Sprintf(NoSuchFileOrDirectory, "nope"))
+
+	if s.cwd != "/" {
+		t.Fatalf("cwd = %q, want / unchanged", s.cwd)
+	}
+}
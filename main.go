@@ -7,6 +7,10 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,34 +19,73 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
+	"time"
+)
+
+// commandsBeforeLogin lists the commands a session may use before PASS
+// succeeds: negotiating TLS and asking about capabilities, plus the login
+// commands themselves.
+var commandsBeforeLogin = map[string]bool{
+	"USER": true,
+	"PASS": true,
+	"SYST": true,
+	"FEAT": true,
+	"QUIT": true,
+	"AUTH": true,
+	"PBSZ": true,
+	"PROT": true,
+}
+
+var (
+	pasvMinPort = flag.Int("pasv-min-port", 0, "lowest port offered in passive/extended-passive mode (0 lets the OS pick)")
+	pasvMaxPort = flag.Int("pasv-max-port", 0, "highest port offered in passive/extended-passive mode (0 lets the OS pick)")
+	tlsCertFile = flag.String("tls-cert", "", "PEM certificate file enabling explicit FTPS (AUTH TLS); requires -tls-key")
+	tlsKeyFile  = flag.String("tls-key", "", "PEM private key file enabling explicit FTPS (AUTH TLS); requires -tls-cert")
+	authMode    = flag.String("auth", "anonymous", "authentication backend: anonymous, htpasswd, or json")
+	authFile    = flag.String("auth-file", "", "credentials file for -auth=htpasswd or -auth=json")
+	metricsAddr = flag.String("metrics-addr", "", "address to serve Prometheus-style metrics on (empty disables it)")
 )
 
 // List of FTP server return codes
 const (
 	AcceptedDataConnection       = "150 Accepted data connection\n"
 	TypeIsNow8BitBinary          = "200 TYPE is now 8-bit binary\n"
-	SystemStatus                 = "211 no-features\n"
-	FileStatus                   = "213 %s\n"
+	PbszCommandSuccessful        = "200 PBSZ command successful\n"
+	ProtCommandSuccessful        = "200 PROT command successful\n"
+	SystemStatus                 = "211-Features:\n EPSV\n EPRT\n%s REST STREAM\n MDTM\n MLSD\n MLST type*;size*;modify*;perm*;\n211 End\n"
+	FileStatus                   = "213 %d\n"
 	NameSystemType               = "215 UNIX Type: L8\n"
 	ServiceReadyForNewUser       = "220 Service ready for new user\n"
 	ServiceClosingConnection     = "221 Service closing control connection\n"
+	ServiceNotAvailableClosing   = "421 Service not available, closing control connection\n"
 	RequestedFileActionTaken     = "226 File successfully transferred\n"
 	ClosingDataConnection        = "226 Closing data connection\n"
 	EnteringPassiveMode          = "227 Entering Passive Mode (%s)\n"
+	EnteringExtendedPassiveMode  = "229 Entering Extended Passive Mode (|||%d|)\n"
+	PortCommandSuccessful        = "200 PORT command successful\n"
+	AuthCommandSuccessful        = "234 AUTH TLS command successful\n"
 	UserLoggedInProceed          = "230 User logged in, proceed\n"
 	RequestedFileActionCompleted = "250 OK. Current directory is %s\n"
 	PathNameDeleted              = "250 Deleted %s\n"
 	PathNameCreated              = "257 Created \"%s\"\n"
 	CurrentWorkingDirectory      = "257 \"%s\"\n"
 	UserOkayNeedPassword         = "331 User %s okay, need password\n"
+	RestartingAtOffset           = "350 Restarting at %d. Send STOR or RETR to continue transfer\n"
+	FileModificationTime         = "213 %s\n"
 	RequestedFileActionNotTaken  = "450 Requested file action not taken\n"
 	RequestedActionHasFailed     = "500 Requested action has failed \"%s\"\n"
 	CommandNotImplemented        = "502 Command not implemented \"%s\"\n"
+	NotLoggedIn                  = "530 Not logged in\n"
+	LoginIncorrect               = "530 Login incorrect\n"
+	TLSNotAvailable              = "550 TLS is not configured on this server\n"
+	PermissionDenied             = "550 Permission denied\n"
+	ReadOnlyAccount              = "550 Permission denied: account is read-only\n"
 	CanOnlyRetrieveRegularFiles  = "550 Can only retrieve regular files\n"
 	NoSuchFileOrDirectory        = "550 No such file or directory %s\n"
 	CantChangeDirectory          = "550 Not a directory %s\n"
@@ -51,61 +94,135 @@ const (
 )
 
 func main() {
-	listener, err := net.Listen("tcp", "localhost:8080")
+	flag.Parse()
+
+	temp, err := seedFolder()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	temp, err := seedFolder()
+	tlsConfig, err := loadTLSConfig(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	authenticator, err := newAuthenticator(*authMode, *authFile, temp)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	handleClose(temp)
+	srv := NewServer()
+	srv.Addr = "localhost:8080"
+	srv.Authenticator = authenticator
+	srv.TLSConfig = tlsConfig
+	srv.PasvMinPort = *pasvMinPort
+	srv.PasvMaxPort = *pasvMaxPort
+	srv.MetricsAddr = *metricsAddr
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println(err) // e.g., connection aborted
-			continue
-		}
+	go waitForShutdownSignal(srv, temp)
+
+	if err := srv.ListenAndServe(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// waitForShutdownSignal blocks until SIGINT/SIGTERM, then drives srv
+// through a graceful shutdown before removing the seeded temp dir and
+// exiting.
+func waitForShutdownSignal(srv *Server, temp string) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-		s := &server{sess: conn, root: temp, path: temp}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
 
-		s.handleResponse(ServiceReadyForNewUser) // automatically accept
+	os.RemoveAll(temp)
+	os.Exit(0)
+}
 
-		go handleConn(s) // handle connections concurrently
+// newAuthenticator builds the Authenticator selected by -auth. anonymousHome
+// is the directory anonymous users are chrooted to when -auth=anonymous.
+func newAuthenticator(mode, file, anonymousHome string) (Authenticator, error) {
+	switch mode {
+	case "anonymous":
+		return NewAnonymousAuthenticator(anonymousHome), nil
+	case "htpasswd":
+		return NewHtpasswdAuthenticator(file, anonymousHome)
+	case "json":
+		return NewJSONAuthenticator(file)
+	default:
+		return nil, fmt.Errorf("unknown -auth backend %q (want anonymous, htpasswd, or json)", mode)
 	}
 }
 
-func handleConn(s *server) {
+func handleConn(s *session) {
 	defer s.sess.Close()
+	defer s.cancel()
+	defer s.closePasv()
+
+	// AUTH TLS reassigns s.sess in place (plaintext net.Conn -> *tls.Conn),
+	// so the scanner has to be rebuilt whenever that happens; one built
+	// once over the original conn would keep reading the handshake's
+	// plaintext side forever.
+	var scanner *bufio.Scanner
+	var scanning net.Conn
+
+	for {
+		if scanning != s.sess {
+			scanning = s.sess
+			scanner = bufio.NewScanner(scanning)
+		}
 
-	cmd := bufio.NewScanner(s.sess)
-	for cmd.Scan() {
-		cmd := cmd.Text()
-		arg := strings.Split(cmd, " ")
+		if !scanner.Scan() {
+			break
+		}
+
+		line := scanner.Text()
+		arg := strings.Split(line, " ")
 
+		verb := line
 		if len(arg) > 1 {
-			cmd = arg[0]
+			verb = arg[0]
+		}
+
+		if !s.loggedIn && !commandsBeforeLogin[verb] {
+			s.handleResponse(NotLoggedIn)
+			continue
 		}
 
-		switch cmd {
+		s.metrics.countCommand(verb)
+
+		switch verb {
 		case "USER":
-			s.handleResponse(fmt.Sprintf(UserOkayNeedPassword, arg[1]))
+			s.handleUser(arg)
 		case "PASS":
-			s.handleResponse(UserLoggedInProceed)
+			s.handlePass(arg)
 		case "SYST":
 			s.handleResponse(fmt.Sprintf(NameSystemType))
 		case "FEAT":
-			s.handleResponse(SystemStatus)
+			s.handleFeat()
 		case "QUIT":
 			s.handleResponse(ServiceClosingConnection)
 			return
 		case "EPSV":
-			s.handleResponse(fmt.Sprintf(CommandNotImplemented, cmd))
+			s.handleExtendedPassive()
 		case "PASV":
 			s.handlePassive()
+		case "PORT":
+			s.handlePort(arg)
+		case "EPRT":
+			s.handleExtendedPort(arg)
+		case "AUTH":
+			s.handleAuth(arg)
+		case "PBSZ":
+			s.handlePBSZ(arg)
+		case "PROT":
+			s.handleProt(arg)
 		case "LIST":
 			s.handleList(arg)
 		case "TYPE":
@@ -116,6 +233,16 @@ func handleConn(s *server) {
 			s.handleRetrieve(arg)
 		case "NLST":
 			s.handleNameList(arg)
+		case "REST":
+			s.handleRestart(arg)
+		case "APPE":
+			s.handleAppend(arg)
+		case "MDTM":
+			s.handleModifyTime(arg)
+		case "MLSD":
+			s.handleMachineList(arg)
+		case "MLST":
+			s.handleMachineListSingle(arg)
 		case "PWD":
 			s.handlePrintWorkingDirectory()
 		case "CWD":
@@ -133,27 +260,17 @@ func handleConn(s *server) {
 		case "STOR":
 			s.handleStore(arg)
 		default:
-			fmt.Println("cmd", cmd)
-			s.handleResponse(fmt.Sprintf(CommandNotImplemented, cmd))
+			fmt.Println("cmd", verb)
+			s.handleResponse(fmt.Sprintf(CommandNotImplemented, verb))
 		}
 	}
 
-	if err := cmd.Err(); err != nil {
+	if err := scanner.Err(); err != nil {
 		log.Println(err) // something went wrong (not io.EOF)
 		return
 	}
 }
 
-func handleClose(path string) {
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		os.RemoveAll(path)
-		os.Exit(0)
-	}()
-}
-
 func seedFolder() (string, error) {
 	temp, err := ioutil.TempDir("", "ftp-")
 	if err != nil {
@@ -188,48 +305,72 @@ func seedFolder() (string, error) {
 	return temp, nil
 }
 
-type server struct {
+type session struct {
 	sess net.Conn
 	pasv net.Listener
-	root string
-	path string
-}
 
-func (s *server) handleResponse(msg string) {
-	_, err := io.WriteString(s.sess, msg)
-	if err != nil {
-		log.Println(err)
-		return // e.g., client disconnected
-	}
+	fs     Filesystem      // virtual filesystem this session's paths resolve against, set at login
+	cwd    string          // current working directory, virtual path rooted at "/"
+	ctx    context.Context // cancelled when the connection is torn down
+	cancel context.CancelFunc
+
+	authenticator Authenticator
+	pendingUser   string // holds USER's argument until PASS arrives
+	loggedIn      bool
+	account       *Account
+
+	uploadLimiter   *rateLimiter
+	downloadLimiter *rateLimiter
+
+	// dataAddr holds the address the client asked us to dial for active
+	// mode (set by PORT/EPRT). When nil, the last mode requested was
+	// passive (PASV/EPSV) and pasv holds the listener to accept from.
+	dataAddr net.Addr
+
+	// mu guards dataConn, which openDataConn's callers (handleConn's
+	// goroutine) and Shutdown (the server's goroutine) can touch
+	// concurrently.
+	mu sync.Mutex
+	// dataConn is the data connection currently open for a transfer, if
+	// any. Shutdown force-closes it to unblock a session stuck in
+	// io.Copy on a stalled data socket, since cancelling ctx or closing
+	// the control connection doesn't touch it.
+	dataConn net.Conn
+
+	pasvMinPort int // 0 means let the OS pick
+	pasvMaxPort int
+
+	tlsConfig *tls.Config // nil unless -tls-cert/-tls-key were set at startup
+	prot      string      // data channel protection level set by PROT: "C" (clear) or "P" (private)
+
+	// restartOffset is set by REST and consumed by the next RETR/STOR/APPE,
+	// which seeks to it before transferring.
+	restartOffset int64
+
+	// metrics receives this session's command and byte counts; nil (the
+	// zero value) silently disables reporting, so sessions built directly
+	// rather than through a Server still work.
+	metrics *metrics
 }
 
-func (s *server) handlePassive() {
-	var err error
-	s.pasv, err = net.Listen("tcp", "") // port automatically chosen
-
-	_, p, err := net.SplitHostPort(s.pasv.Addr().String())
-	h, _, err := net.SplitHostPort(s.sess.LocalAddr().String())
-
-	addr, err := net.ResolveIPAddr("", h)
-	port, err := strconv.ParseInt(p, 10, 64)
-
-	ip := addr.IP.To4()
-
-	location := fmt.Sprintf(
-		"%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port/256, port%256,
-	)
+// consumeRestartOffset returns the offset set by a prior REST command and
+// clears it, so it only ever applies to the single transfer that follows.
+func (s *session) consumeRestartOffset() int64 {
+	off := s.restartOffset
+	s.restartOffset = 0
+	return off
+}
 
+func (s *session) handleResponse(msg string) {
+	_, err := io.WriteString(s.sess, msg)
 	if err != nil {
 		log.Println(err)
-		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PASV"))
-		return
+		return // e.g., client disconnected
 	}
-
-	s.handleResponse(fmt.Sprintf(EnteringPassiveMode, location))
 }
 
-func (s *server) handleList(arg []string) {
-	conn, err := s.pasv.Accept()
+func (s *session) handleList(arg []string) {
+	conn, err := s.openDataConn()
 	if err != nil {
 		log.Println(err) // e.g., connection aborted
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "LIST"))
@@ -246,15 +387,20 @@ func (s *server) handleList(arg []string) {
 		const format = "%s\t%3v %s\t%s\t%12v %s %s\r\n"
 
 		mode := file.Mode().String()
-		link := file.Sys().(*syscall.Stat_t).Nlink
 
-		uid := strconv.Itoa(int(file.Sys().(*syscall.Stat_t).Uid))
-		owner, _ := user.LookupId(uid)
-		username := owner.Username
+		var link uint64 = 1
+		username, groupname := "owner", "group"
+
+		if stat, ok := file.Sys().(*syscall.Stat_t); ok {
+			link = stat.Nlink
 
-		gid := strconv.Itoa(int(file.Sys().(*syscall.Stat_t).Gid))
-		group, _ := user.LookupGroupId(gid)
-		groupname := group.Name
+			if owner, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+				username = owner.Username
+			}
+			if group, err := user.LookupGroupId(strconv.Itoa(int(stat.Gid))); err == nil {
+				groupname = group.Name
+			}
+		}
 
 		size := file.Size()
 		time := file.ModTime().Format("Jan  2 15:04")
@@ -270,7 +416,11 @@ func (s *server) handleList(arg []string) {
 	switch a := len(arg); a {
 	// list current working directory
 	case 1:
-		files, err := ioutil.ReadDir(s.path)
+		files, err := s.fs.ReadDir(s.ctx, s.cwd)
+		if errors.Is(err, ErrEscape) {
+			s.handleResponse(PermissionDenied)
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			s.handleResponse(RequestedFileActionNotTaken)
@@ -282,19 +432,16 @@ func (s *server) handleList(arg []string) {
 		}
 	// list specific file or directory content
 	case 2:
-		dir := filepath.Clean(arg[1])
-		path, _ := filepath.Abs(filepath.Join(s.path, dir))
+		target := virtualJoin(s.cwd, arg[1])
 
-		// Prevent listing a directory above root
-		if !strings.HasPrefix(path, s.root) {
-			dir := filepath.Clean("/" + dir)
-			path, _ = filepath.Abs(filepath.Join(s.root, dir))
+		info, err := s.fs.Stat(s.ctx, target)
+		if errors.Is(err, ErrEscape) {
+			s.handleResponse(PermissionDenied)
+			return
 		}
-
-		info, err := os.Stat(path)
 		if os.IsNotExist(err) {
 			log.Println(err)
-			s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, dir))
+			s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
 			return
 		}
 		if err != nil {
@@ -307,7 +454,7 @@ func (s *server) handleList(arg []string) {
 			break
 		}
 
-		files, err := ioutil.ReadDir(path)
+		files, err := s.fs.ReadDir(s.ctx, target)
 		if err != nil {
 			log.Println(err)
 			s.handleResponse(RequestedFileActionNotTaken)
@@ -322,18 +469,19 @@ func (s *server) handleList(arg []string) {
 	s.handleResponse(ClosingDataConnection)
 }
 
-func (s *server) handleSize(arg []string) {
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
-
-	file, err := os.Open(path)
-	if err != nil {
-		log.Println(err)
+func (s *session) handleSize(arg []string) {
+	if len(arg) != 2 {
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "SIZE"))
 		return
 	}
 
-	info, err := file.Stat()
+	target := virtualJoin(s.cwd, arg[1])
+
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "SIZE"))
@@ -343,8 +491,13 @@ func (s *server) handleSize(arg []string) {
 	s.handleResponse(fmt.Sprintf(FileStatus, info.Size()))
 }
 
-func (s *server) handleRetrieve(arg []string) {
-	conn, err := s.pasv.Accept()
+func (s *session) handleRetrieve(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "RETR"))
+		return
+	}
+
+	conn, err := s.openDataConn()
 	if err != nil {
 		log.Println(err) // e.g., connection aborted
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "RETR"))
@@ -353,21 +506,19 @@ func (s *server) handleRetrieve(arg []string) {
 
 	defer conn.Close()
 
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
+	target := virtualJoin(s.cwd, arg[1])
 
-	// Prevent retrieving a remote-file above root
-	if !strings.HasPrefix(path, s.root) {
-		dir := filepath.Clean("/" + dir)
-		path, _ = filepath.Abs(filepath.Join(s.root, dir))
+	file, err := s.fs.OpenFile(s.ctx, target, os.O_RDONLY, 0)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
 	}
-
-	file, err := os.Open(path)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(RequestedFileActionNotTaken)
 		return
 	}
+	defer file.Close()
 
 	info, err := file.Stat()
 	if err != nil {
@@ -380,9 +531,18 @@ func (s *server) handleRetrieve(arg []string) {
 		return
 	}
 
+	if off := s.consumeRestartOffset(); off > 0 {
+		if _, err := file.Seek(off, io.SeekStart); err != nil {
+			log.Println(err)
+			s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "RETR"))
+			return
+		}
+	}
+
 	s.handleResponse(AcceptedDataConnection)
 
-	_, err = io.Copy(conn, file)
+	n, err := io.Copy(&limitedWriter{w: conn, lim: s.downloadLimiter}, file)
+	s.metrics.addBytesOut(n)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(RequestedFileActionNotTaken)
@@ -392,8 +552,8 @@ func (s *server) handleRetrieve(arg []string) {
 	s.handleResponse(RequestedFileActionTaken)
 }
 
-func (s *server) handleNameList(arg []string) {
-	conn, err := s.pasv.Accept()
+func (s *session) handleNameList(arg []string) {
+	conn, err := s.openDataConn()
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "NLST"))
@@ -404,19 +564,17 @@ func (s *server) handleNameList(arg []string) {
 
 	s.handleResponse(AcceptedDataConnection)
 
-	path := s.path
+	target := s.cwd
 	if len(arg) > 1 {
 		// Support sub-directory listing when available
-		path, _ = filepath.Abs(filepath.Join(s.path, arg[1]))
+		target = virtualJoin(s.cwd, arg[1])
 	}
 
-	// Prevent listing a directory above root
-	if !strings.HasPrefix(path, s.root) {
-		dir := filepath.Clean("/" + arg[1])
-		path, _ = filepath.Abs(filepath.Join(s.root, dir))
+	files, err := s.fs.ReadDir(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
 	}
-
-	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(RequestedFileActionNotTaken)
@@ -430,36 +588,25 @@ func (s *server) handleNameList(arg []string) {
 	s.handleResponse(ClosingDataConnection)
 }
 
-func (s *server) handlePrintWorkingDirectory() {
-	// Print base directory instead of full path
-	// (e.g. /dir instead of /root/dir)
-	dir := strings.Split(s.path, s.root)[1]
-	if dir != "" {
-		s.handleResponse(fmt.Sprintf(CurrentWorkingDirectory, dir))
-		return
-	}
-
-	s.handleResponse(fmt.Sprintf(CurrentWorkingDirectory, "/"))
+func (s *session) handlePrintWorkingDirectory() {
+	s.handleResponse(fmt.Sprintf(CurrentWorkingDirectory, s.cwd))
 }
 
-func (s *server) handleChangeWorkingDirectory(arg []string) {
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
-
-	// Prevent changing to a directory above root
-	if !strings.HasPrefix(path, s.root) {
-		s.path = s.root
-		s.handleResponse(fmt.Sprintf(RequestedFileActionCompleted, "/"))
+func (s *session) handleChangeWorkingDirectory(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "CWD"))
 		return
 	}
 
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, dir))
+	target := virtualJoin(s.cwd, arg[1])
+
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
 		return
 	}
-	if !info.IsDir() {
-		s.handleResponse(fmt.Sprintf(CantChangeDirectory, dir))
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
 		return
 	}
 	if err != nil {
@@ -467,32 +614,36 @@ func (s *server) handleChangeWorkingDirectory(arg []string) {
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "CWD"))
 		return
 	}
-
-	s.path = path
-	if d := strings.Split(s.path, s.root)[1]; d != "" {
-		s.handleResponse(fmt.Sprintf(RequestedFileActionCompleted, d))
+	if !info.IsDir() {
+		s.handleResponse(fmt.Sprintf(CantChangeDirectory, arg[1]))
 		return
 	}
 
-	s.handleResponse(fmt.Sprintf(RequestedFileActionCompleted, "/"))
+	s.cwd = target
+	s.handleResponse(fmt.Sprintf(RequestedFileActionCompleted, s.cwd))
 }
 
-func (s *server) handleMakeDirectory(arg []string) {
+func (s *session) handleMakeDirectory(arg []string) {
+	if s.account != nil && s.account.ReadOnly {
+		s.handleResponse(ReadOnlyAccount)
+		return
+	}
+
 	if len(arg) != 2 {
 		s.handleResponse("usage: mkdir directory-name\n")
+		return
 	}
 
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
+	target := virtualJoin(s.cwd, arg[1])
 
 	// Check if the parent directory exists before creating children
-	info, err := os.Stat(filepath.Dir(path))
-	if os.IsNotExist(err) {
-		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, dir))
+	info, err := s.fs.Stat(s.ctx, path.Dir(target))
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
 		return
 	}
-	if !info.IsDir() {
-		s.handleResponse(fmt.Sprintf(CantChangeDirectory, dir))
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
 		return
 	}
 	if err != nil {
@@ -500,28 +651,16 @@ func (s *server) handleMakeDirectory(arg []string) {
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MKD"))
 		return
 	}
-
-	// Prevent creating a directory above root
-	if !strings.HasPrefix(path, s.root) {
-		dir := filepath.Clean("/" + dir)
-		path, _ := filepath.Abs(filepath.Join(s.root, dir))
-
-		err := os.Mkdir(path, 0755)
-		if os.IsExist(err) {
-			s.handleResponse(fmt.Sprintf(CantCreateDirectory))
-			return
-		}
-		if err != nil {
-			log.Println(err)
-			s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MKD"))
-			return
-		}
-
-		s.handleResponse(fmt.Sprintf(PathNameCreated, dir))
+	if !info.IsDir() {
+		s.handleResponse(fmt.Sprintf(CantChangeDirectory, arg[1]))
 		return
 	}
 
-	err = os.Mkdir(path, 0755)
+	err = s.fs.Mkdir(s.ctx, target, 0755)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
 	if os.IsExist(err) {
 		s.handleResponse(fmt.Sprintf(CantCreateDirectory))
 		return
@@ -532,30 +671,29 @@ func (s *server) handleMakeDirectory(arg []string) {
 		return
 	}
 
-	s.handleResponse(fmt.Sprintf(PathNameCreated, dir))
+	s.handleResponse(fmt.Sprintf(PathNameCreated, target))
 }
 
-func (s *server) handleRemoveDirectory(arg []string) {
+func (s *session) handleRemoveDirectory(arg []string) {
+	if s.account != nil && s.account.ReadOnly {
+		s.handleResponse(ReadOnlyAccount)
+		return
+	}
+
 	if len(arg) != 2 {
 		s.handleResponse("usage: rm directory-name\n")
+		return
 	}
 
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
-
-	// Prevent deleting a directory above root
-	if !strings.HasPrefix(path, s.root) {
-		dir := filepath.Clean("/" + dir)
-		path, _ = filepath.Abs(filepath.Join(s.root, dir))
-	}
+	target := virtualJoin(s.cwd, arg[1])
 
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, dir))
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
 		return
 	}
-	if !info.IsDir() {
-		s.handleResponse(fmt.Sprintf(CantChangeDirectory, dir))
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
 		return
 	}
 	if err != nil {
@@ -563,38 +701,41 @@ func (s *server) handleRemoveDirectory(arg []string) {
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "RMD"))
 		return
 	}
+	if !info.IsDir() {
+		s.handleResponse(fmt.Sprintf(CantChangeDirectory, arg[1]))
+		return
+	}
 
-	err = os.RemoveAll(path)
+	err = s.fs.RemoveAll(s.ctx, target)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "RMD"))
 		return
 	}
 
-	s.handleResponse(fmt.Sprintf(PathNameDeleted, dir))
+	s.handleResponse(fmt.Sprintf(PathNameDeleted, arg[1]))
 }
 
-func (s *server) handleDelete(arg []string) {
+func (s *session) handleDelete(arg []string) {
+	if s.account != nil && s.account.ReadOnly {
+		s.handleResponse(ReadOnlyAccount)
+		return
+	}
+
 	if len(arg) != 2 {
 		s.handleResponse("usage: delete remote-file\n")
+		return
 	}
 
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
-
-	// Prevent deleting a remote-file above root
-	if !strings.HasPrefix(path, s.root) {
-		dir := filepath.Clean("/" + dir)
-		path, _ = filepath.Abs(filepath.Join(s.root, dir))
-	}
+	target := virtualJoin(s.cwd, arg[1])
 
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, dir))
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
 		return
 	}
-	if info.IsDir() {
-		s.handleResponse(CanOnlyDeleteRegularFiles)
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
 		return
 	}
 	if err != nil {
@@ -602,19 +743,33 @@ func (s *server) handleDelete(arg []string) {
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "DELE"))
 		return
 	}
+	if info.IsDir() {
+		s.handleResponse(CanOnlyDeleteRegularFiles)
+		return
+	}
 
-	err = os.Remove(path)
+	err = s.fs.RemoveAll(s.ctx, target)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "DELE"))
 		return
 	}
 
-	s.handleResponse(fmt.Sprintf(PathNameDeleted, dir))
+	s.handleResponse(fmt.Sprintf(PathNameDeleted, arg[1]))
 }
 
-func (s *server) handleStore(arg []string) {
-	conn, err := s.pasv.Accept()
+func (s *session) handleStore(arg []string) {
+	if s.account != nil && s.account.ReadOnly {
+		s.handleResponse(ReadOnlyAccount)
+		return
+	}
+
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "STOR"))
+		return
+	}
+
+	conn, err := s.openDataConn()
 	if err != nil {
 		log.Println(err) // e.g., connection aborted
 		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "STOR"))
@@ -625,17 +780,37 @@ func (s *server) handleStore(arg []string) {
 
 	s.handleResponse(AcceptedDataConnection)
 
-	dir := filepath.Clean(arg[1])
-	path, _ := filepath.Abs(filepath.Join(s.path, dir))
+	target := virtualJoin(s.cwd, arg[1])
+
+	off := s.consumeRestartOffset()
 
-	file, err := os.Create(path)
+	flag := os.O_WRONLY | os.O_CREATE
+	if off == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	file, err := s.fs.OpenFile(s.ctx, target, flag, 0666)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(RequestedFileActionNotTaken)
 		return
 	}
+	defer file.Close()
+
+	if off > 0 {
+		if _, err := file.Seek(off, io.SeekStart); err != nil {
+			log.Println(err)
+			s.handleResponse(RequestedFileActionNotTaken)
+			return
+		}
+	}
 
-	_, err = io.Copy(file, conn)
+	n, err := io.Copy(file, &limitedReader{r: conn, lim: s.uploadLimiter})
+	s.metrics.addBytesIn(n)
 	if err != nil {
 		log.Println(err)
 		s.handleResponse(RequestedFileActionNotTaken)
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory Filesystem, used by tests to exercise handlers
+// without touching the real disk.
+type MemFS struct {
+	mu   sync.Mutex
+	root *memNode
+}
+
+// NewMemFS returns an empty, ready-to-use in-memory Filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{root: newMemDir("/")}
+}
+
+type memNode struct {
+	name     string
+	isDir    bool
+	mode     os.FileMode
+	data     []byte
+	modTime  time.Time
+	children map[string]*memNode
+}
+
+func newMemDir(name string) *memNode {
+	return &memNode{name: name, isDir: true, mode: os.ModeDir | 0755, children: map[string]*memNode{}}
+}
+
+func pathErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// split walks name's components against fs.root, returning the parent
+// directory node and the final component, without requiring the final
+// component itself to exist.
+func (fs *MemFS) split(name string) (*memNode, string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return nil, "", pathErr("open", name, os.ErrInvalid)
+	}
+
+	parts := splitPath(clean)
+	dir := fs.root
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := dir.children[part]
+		if !ok || !child.isDir {
+			return nil, "", pathErr("open", name, os.ErrNotExist)
+		}
+		dir = child
+	}
+
+	return dir, parts[len(parts)-1], nil
+}
+
+func splitPath(clean string) []string {
+	var parts []string
+	for _, p := range strings.Split(clean, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func (fs *MemFS) lookup(name string) (*memNode, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return fs.root, nil
+	}
+
+	dir, base, err := fs.split(name)
+	if err != nil {
+		return nil, err
+	}
+
+	node, ok := dir.children[base]
+	if !ok {
+		return nil, pathErr("stat", name, os.ErrNotExist)
+	}
+
+	return node, nil
+}
+
+func (fs *MemFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base, err := fs.split(name)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.children[base]; exists {
+		return pathErr("mkdir", name, os.ErrExist)
+	}
+
+	node := newMemDir(base)
+	node.mode = os.ModeDir | perm
+	node.modTime = time.Now()
+	dir.children[base] = node
+
+	return nil
+}
+
+func (fs *MemFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base, err := fs.split(name)
+	if err != nil {
+		return nil, err
+	}
+
+	node, exists := dir.children[base]
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, pathErr("open", name, os.ErrNotExist)
+		}
+		node = &memNode{name: base, mode: perm, modTime: time.Now()}
+		dir.children[base] = node
+	} else if flag&os.O_EXCL != 0 {
+		return nil, pathErr("open", name, os.ErrExist)
+	}
+
+	if node.isDir {
+		return nil, pathErr("open", name, os.ErrInvalid)
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+
+	var offset int64
+	if flag&os.O_APPEND != 0 {
+		offset = int64(len(node.data))
+	}
+
+	return &memFile{fs: fs, node: node, offset: offset}, nil
+}
+
+func (fs *MemFS) RemoveAll(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base, err := fs.split(name)
+	if err != nil {
+		return err
+	}
+
+	delete(dir.children, base)
+	return nil
+}
+
+func (fs *MemFS) Rename(ctx context.Context, oldname, newname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldDir, oldBase, err := fs.split(oldname)
+	if err != nil {
+		return err
+	}
+	node, ok := oldDir.children[oldBase]
+	if !ok {
+		return pathErr("rename", oldname, os.ErrNotExist)
+	}
+
+	newDir, newBase, err := fs.split(newname)
+	if err != nil {
+		return err
+	}
+
+	node.name = newBase
+	newDir.children[newBase] = node
+	delete(oldDir.children, oldBase)
+
+	return nil
+}
+
+func (fs *MemFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memFileInfo{node}, nil
+}
+
+func (fs *MemFS) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir {
+		return nil, pathErr("readdir", name, os.ErrInvalid)
+	}
+
+	infos := make([]os.FileInfo, 0, len(node.children))
+	for _, child := range node.children {
+		infos = append(infos, &memFileInfo{child})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	offset int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		f.offset = int64(len(f.node.data)) + offset
+	}
+
+	return f.offset, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return &memFileInfo{f.node}, nil
+}
+
+type memFileInfo struct {
+	node *memNode
+}
+
+func (i *memFileInfo) Name() string { return i.node.name }
+
+func (i *memFileInfo) Size() int64 {
+	if i.node.isDir {
+		return 0
+	}
+	return int64(len(i.node.data))
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.node.mode != 0 {
+		return i.node.mode
+	}
+	return 0644
+}
+
+func (i *memFileInfo) ModTime() time.Time { return i.node.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.node.isDir }
+func (i *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics collects the counters a Server exposes on its metrics endpoint,
+// in the Prometheus text exposition format. A nil *metrics is valid and
+// every method is a no-op on it, so a session built without a Server
+// (e.g. in tests) doesn't need one.
+type metrics struct {
+	bytesIn        int64
+	bytesOut       int64
+	activeSessions int64
+
+	mu            sync.Mutex
+	commandCounts map[string]int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{commandCounts: map[string]int64{}}
+}
+
+func (m *metrics) addBytesIn(n int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesIn, n)
+}
+
+func (m *metrics) addBytesOut(n int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesOut, n)
+}
+
+func (m *metrics) addActiveSessions(delta int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeSessions, delta)
+}
+
+func (m *metrics) countCommand(verb string) {
+	if m == nil || verb == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commandCounts[verb]++
+}
+
+// ServeHTTP renders the current counters in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "# TYPE ftp_bytes_in_total counter\nftp_bytes_in_total %d\n", atomic.LoadInt64(&m.bytesIn))
+	fmt.Fprintf(w, "# TYPE ftp_bytes_out_total counter\nftp_bytes_out_total %d\n", atomic.LoadInt64(&m.bytesOut))
+	fmt.Fprintf(w, "# TYPE ftp_active_sessions gauge\nftp_active_sessions %d\n", atomic.LoadInt64(&m.activeSessions))
+
+	m.mu.Lock()
+	verbs := make([]string, 0, len(m.commandCounts))
+	for verb := range m.commandCounts {
+		verbs = append(verbs, verb)
+	}
+	counts := m.commandCounts
+	sort.Strings(verbs)
+
+	fmt.Fprint(w, "# TYPE ftp_commands_total counter\n")
+	for _, verb := range verbs {
+		fmt.Fprintf(w, "ftp_commands_total{verb=%q} %d\n", verb, counts[verb])
+	}
+	m.mu.Unlock()
+}
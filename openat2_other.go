@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openat2Supported is always false outside Linux; resolveWithinRoot's
+// portable symlink walk is the only defense on these platforms.
+func openat2Supported() bool { return false }
+
+func openat2VerifyBeneath(root, resolved string) error { return nil }
+
+// openat2OpenBeneath is never called outside Linux, since callers check
+// openat2Supported first.
+func openat2OpenBeneath(root, rel string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, errors.New("openat2 is not supported on this platform")
+}
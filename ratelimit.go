@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token bucket: bytesPerSec tokens refill every
+// second, and wait blocks just long enough to keep the long-run average
+// throughput at or below that rate.
+type rateLimiter struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	tokens      float64
+	last        time.Time
+}
+
+// newRateLimiter returns a limiter capping throughput at bytesPerSec, or
+// nil (meaning unlimited) if bytesPerSec is not positive.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSec: bytesPerSec, tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.bytesPerSec)
+	if max := float64(r.bytesPerSec); r.tokens > max {
+		r.tokens = max
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens < 0 {
+		time.Sleep(time.Duration(-r.tokens / float64(r.bytesPerSec) * float64(time.Second)))
+		r.tokens = 0
+	}
+}
+
+// limitedReader throttles Read calls to lim's rate; a nil lim disables
+// throttling.
+type limitedReader struct {
+	r   io.Reader
+	lim *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.lim.wait(n)
+	}
+	return n, err
+}
+
+// limitedWriter throttles Write calls to lim's rate; a nil lim disables
+// throttling.
+type limitedWriter struct {
+	w   io.Writer
+	lim *rateLimiter
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.lim.wait(n)
+	}
+	return n, err
+}
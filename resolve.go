@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrEscape is returned by resolveWithinRoot when rel, once symlinks are
+// followed, would resolve to a path outside root.
+var ErrEscape = errors.New("resolve: path escapes root")
+
+// resolveWithinRoot resolves the virtual path rel against root, following
+// any symlinks encountered along the way, and fails closed with ErrEscape
+// if any of them point outside root. Unlike a lexical join (which only
+// defends against ".." segments in rel), this also catches a symlink
+// planted inside root whose target points elsewhere on disk.
+//
+// The final path component is allowed to not exist, so callers can use
+// this to validate the destination of an O_CREATE open or a Mkdir.
+func resolveWithinRoot(root, rel string) (string, error) {
+	root = filepath.Clean(root)
+	rel = filepath.Clean("/" + rel)
+
+	if rel == "/" {
+		return root, nil
+	}
+
+	components := strings.Split(strings.TrimPrefix(rel, "/"), string(filepath.Separator))
+
+	current := root
+	for i, comp := range components {
+		next := filepath.Join(current, comp)
+
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) && i == len(components)-1 {
+			current = next
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			resolved, err := resolveSymlinkWithinRoot(root, next)
+			if err != nil {
+				return "", err
+			}
+			current = resolved
+			continue
+		}
+
+		current = next
+	}
+
+	if current != root && !strings.HasPrefix(current, root+string(filepath.Separator)) {
+		return "", ErrEscape
+	}
+
+	return current, nil
+}
+
+// resolveSymlinkWithinRoot follows the symlink chain starting at linkPath,
+// rejecting it the moment any link's target falls outside root.
+func resolveSymlinkWithinRoot(root, linkPath string) (string, error) {
+	const maxDepth = 40
+
+	target := linkPath
+	for depth := 0; depth < maxDepth; depth++ {
+		dest, err := os.Readlink(target)
+		if err != nil {
+			return "", err
+		}
+
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(filepath.Dir(target), dest)
+		}
+		dest = filepath.Clean(dest)
+
+		if dest != root && !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+			return "", ErrEscape
+		}
+
+		info, err := os.Lstat(dest)
+		if os.IsNotExist(err) {
+			return dest, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return dest, nil
+		}
+
+		target = dest
+	}
+
+	return "", errors.New("resolveWithinRoot: too many levels of symbolic links")
+}
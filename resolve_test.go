@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// escapeFixture builds root/escape -> outside, a symlink planted inside a
+// fresh temp root pointing at a second, unrelated temp dir, and returns
+// root.
+func escapeFixture(t *testing.T) (root string) {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "root-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	outside, err := ioutil.TempDir("", "outside-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(outside) })
+
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("top secret"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	return root
+}
+
+func TestResolveWithinRootRejectsSymlinkEscape(t *testing.T) {
+	root := escapeFixture(t)
+
+	if _, err := resolveWithinRoot(root, "/escape/secret.txt"); err != ErrEscape {
+		t.Fatalf("resolveWithinRoot() = %v, want ErrEscape", err)
+	}
+}
+
+func TestResolveWithinRootAllowsPathsInsideRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "root-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	resolved, err := resolveWithinRoot(root, "/file.txt")
+	if err != nil {
+		t.Fatalf("resolveWithinRoot() = %v, want nil error", err)
+	}
+	if want := filepath.Join(root, "file.txt"); resolved != want {
+		t.Fatalf("resolved = %q, want %q", resolved, want)
+	}
+}
+
+func TestResolveWithinRootAllowsNonexistentCreateTarget(t *testing.T) {
+	root, err := ioutil.TempDir("", "root-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	resolved, err := resolveWithinRoot(root, "/new-file.txt")
+	if err != nil {
+		t.Fatalf("resolveWithinRoot() = %v, want nil error", err)
+	}
+	if want := filepath.Join(root, "new-file.txt"); resolved != want {
+		t.Fatalf("resolved = %q, want %q", resolved, want)
+	}
+}
+
+// dirFSHandlerFixture returns a *session whose fs is a real DirFS rooted at
+// a fresh temp dir containing a symlink escaping it, for exercising the
+// command handlers end to end.
+func dirFSHandlerFixture(t *testing.T) *session {
+	t.Helper()
+
+	root := escapeFixture(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &session{fs: NewDirFS(root), cwd: "/", ctx: ctx, cancel: cancel}
+}
+
+func TestHandleDeleteRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	s.handleDelete([]string{"DELE", "escape/secret.txt"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleRemoveDirectoryRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	s.handleRemoveDirectory([]string{"RMD", "escape"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleMakeDirectoryRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	s.handleMakeDirectory([]string{"MKD", "escape/newdir"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleChangeWorkingDirectoryRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	s.handleChangeWorkingDirectory([]string{"CWD", "escape"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleSizeRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	s.handleSize([]string{"SIZE", "escape/secret.txt"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+// attachPassiveDataConn gives s a passive listener with a connection
+// already queued on it, the way a real client would after PASV/EPSV, so
+// handlers that open a data connection before touching the filesystem
+// (LIST/RETR/STOR/NLST) don't block on s.openDataConn().
+func attachPassiveDataConn(t *testing.T, s *session) func() {
+	t.Helper()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s.pasv = ln
+
+	dataClient, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial data conn: %v", err)
+	}
+
+	return func() { dataClient.Close() }
+}
+
+func TestHandleListRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	defer attachPassiveDataConn(t, s)()
+
+	s.handleList([]string{"LIST", "escape"})
+	assertResponse(t, client, AcceptedDataConnection)
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleRetrieveRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	defer attachPassiveDataConn(t, s)()
+
+	s.handleRetrieve([]string{"RETR", "escape/secret.txt"})
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleStoreRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	defer attachPassiveDataConn(t, s)()
+
+	s.handleStore([]string{"STOR", "escape/newfile.txt"})
+	assertResponse(t, client, AcceptedDataConnection)
+	assertResponse(t, client, PermissionDenied)
+}
+
+func TestHandleNameListRefusesSymlinkEscape(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	fixture := dirFSHandlerFixture(t)
+	s.fs, s.cwd = fixture.fs, fixture.cwd
+
+	defer attachPassiveDataConn(t, s)()
+
+	s.handleNameList([]string{"NLST", "escape"})
+	assertResponse(t, client, AcceptedDataConnection)
+	assertResponse(t, client, PermissionDenied)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// handleRestart implements REST, which primes the next RETR/STOR/APPE to
+// seek past offset bytes before transferring, so an interrupted transfer
+// can resume instead of starting over.
+func (s *session) handleRestart(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "REST"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(arg[1], 10, 64)
+	if err != nil || offset < 0 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "REST"))
+		return
+	}
+
+	s.restartOffset = offset
+	s.handleResponse(fmt.Sprintf(RestartingAtOffset, offset))
+}
+
+// handleAppend implements APPE, storing to the end of an existing file
+// (creating it if necessary) instead of truncating it like STOR.
+func (s *session) handleAppend(arg []string) {
+	if s.account != nil && s.account.ReadOnly {
+		s.handleResponse(ReadOnlyAccount)
+		return
+	}
+
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "APPE"))
+		return
+	}
+
+	conn, err := s.openDataConn()
+	if err != nil {
+		log.Println(err) // e.g., connection aborted
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "APPE"))
+		return
+	}
+
+	defer conn.Close()
+
+	s.handleResponse(AcceptedDataConnection)
+
+	s.consumeRestartOffset() // APPE always targets EOF; REST doesn't apply
+
+	target := virtualJoin(s.cwd, arg[1])
+
+	file, err := s.fs.OpenFile(s.ctx, target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(RequestedFileActionNotTaken)
+		return
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, &limitedReader{r: conn, lim: s.uploadLimiter})
+	s.metrics.addBytesIn(n)
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(RequestedFileActionNotTaken)
+		return
+	}
+
+	s.handleResponse(RequestedFileActionTaken)
+}
+
+// handleModifyTime implements MDTM, reporting a file's last-modified time
+// in the "YYYYMMDDHHMMSS" format RFC 3659 expects.
+func (s *session) handleModifyTime(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MDTM"))
+		return
+	}
+
+	target := virtualJoin(s.cwd, arg[1])
+
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, arg[1]))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MDTM"))
+		return
+	}
+
+	s.handleResponse(fmt.Sprintf(FileModificationTime, info.ModTime().UTC().Format("20060102150405")))
+}
+
+// machineFacts renders the RFC 3659 fact string for info: "type=...;
+// size=...;modify=...;perm=...; name".
+func machineFacts(info os.FileInfo) string {
+	modify := info.ModTime().UTC().Format("20060102150405")
+
+	if info.IsDir() {
+		return fmt.Sprintf("type=dir;modify=%s;perm=el; %s", modify, info.Name())
+	}
+
+	return fmt.Sprintf("type=file;size=%d;modify=%s;perm=rw; %s", info.Size(), modify, info.Name())
+}
+
+// handleMachineList implements MLSD, a machine-parseable counterpart to
+// LIST served over the data connection.
+func (s *session) handleMachineList(arg []string) {
+	conn, err := s.openDataConn()
+	if err != nil {
+		log.Println(err) // e.g., connection aborted
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MLSD"))
+		return
+	}
+
+	defer conn.Close()
+
+	s.handleResponse(AcceptedDataConnection)
+
+	target := s.cwd
+	if len(arg) > 1 {
+		target = virtualJoin(s.cwd, arg[1])
+	}
+
+	files, err := s.fs.ReadDir(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(RequestedFileActionNotTaken)
+		return
+	}
+
+	for _, file := range files {
+		fmt.Fprintf(conn, "%s\r\n", machineFacts(file))
+	}
+
+	s.handleResponse(ClosingDataConnection)
+}
+
+// handleMachineListSingle implements MLST, which reports facts for a
+// single file or directory over the control connection.
+func (s *session) handleMachineListSingle(arg []string) {
+	target := s.cwd
+	if len(arg) > 1 {
+		target = virtualJoin(s.cwd, arg[1])
+	}
+
+	info, err := s.fs.Stat(s.ctx, target)
+	if errors.Is(err, ErrEscape) {
+		s.handleResponse(PermissionDenied)
+		return
+	}
+	if os.IsNotExist(err) {
+		s.handleResponse(fmt.Sprintf(NoSuchFileOrDirectory, target))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "MLST"))
+		return
+	}
+
+	s.handleResponse(fmt.Sprintf("250-Listing %s\r\n %s\r\n250 End\r\n", target, machineFacts(info)))
+}
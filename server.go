@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server is a structured, embeddable FTP server. Construct one with
+// NewServer, configure its exported fields, then call ListenAndServe to
+// accept connections until Shutdown (or ListenAndServe's context) ends it.
+type Server struct {
+	Addr          string        // address to listen on, e.g. "localhost:8080"
+	Authenticator Authenticator // required; see newAuthenticator for the built-in backends
+	TLSConfig     *tls.Config   // nil disables AUTH TLS
+	PasvMinPort   int           // 0 lets the OS pick passive/extended-passive ports
+	PasvMaxPort   int
+	MetricsAddr   string // address to serve Prometheus-style metrics on; empty disables it
+
+	metrics *metrics
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[*session]struct{}
+	wg       sync.WaitGroup
+	closing  bool
+}
+
+// NewServer returns a Server ready to have its fields set and ListenAndServe
+// called.
+func NewServer() *Server {
+	return &Server{metrics: newMetrics(), sessions: map[*session]struct{}{}}
+}
+
+// ListenAndServe accepts connections on srv.Addr until ctx is cancelled or
+// Shutdown is called, handling each on its own goroutine. It always returns
+// a non-nil error, except when Shutdown triggered the exit.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	srv.listener = ln
+	srv.mu.Unlock()
+
+	if srv.MetricsAddr != "" {
+		go srv.serveMetrics()
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closing := srv.closing
+			srv.mu.Unlock()
+			if closing {
+				return nil
+			}
+			log.Println(err) // e.g., connection aborted
+			continue
+		}
+
+		sessCtx, cancel := context.WithCancel(ctx)
+		s := &session{
+			sess:          conn,
+			ctx:           sessCtx,
+			cancel:        cancel,
+			pasvMinPort:   srv.PasvMinPort,
+			pasvMaxPort:   srv.PasvMaxPort,
+			tlsConfig:     srv.TLSConfig,
+			prot:          "C",
+			authenticator: srv.Authenticator,
+			metrics:       srv.metrics,
+		}
+
+		srv.register(s)
+		s.handleResponse(ServiceReadyForNewUser) // automatically accept
+
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			defer srv.unregister(s)
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("panic handling connection:", r)
+				}
+			}()
+			handleConn(s)
+		}()
+	}
+}
+
+// serveMetrics runs the metrics HTTP endpoint until the process exits;
+// errors are logged rather than fatal, since it's a secondary concern to
+// the FTP service itself.
+func (srv *Server) serveMetrics() {
+	if err := http.ListenAndServe(srv.MetricsAddr, srv.metrics); err != nil {
+		log.Println(err)
+	}
+}
+
+func (srv *Server) register(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sessions[s] = struct{}{}
+	srv.metrics.addActiveSessions(1)
+}
+
+func (srv *Server) unregister(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.sessions, s)
+	srv.metrics.addActiveSessions(-1)
+}
+
+// Shutdown stops accepting new connections, tells every live session the
+// server is going away, and waits for in-flight transfers to finish on
+// their own. Only once ctx's deadline passes does it forcibly cancel and
+// close whatever sessions are still running, including any data
+// connection they have open, so Shutdown never blocks past ctx's
+// deadline even on a session stuck mid-transfer.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	sessions := make([]*session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.mu.Unlock()
+
+	for _, s := range sessions {
+		s.handleResponse(ServiceNotAvailableClosing)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, s := range sessions {
+		s.cancel()
+		s.sess.Close()
+		s.closeDataConn()
+	}
+	<-done
+
+	return ctx.Err()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer launches srv.ListenAndServe on an OS-assigned port and
+// waits until it's actually listening, returning the address to dial and a
+// cleanup func that shuts the server down.
+func startTestServer(t *testing.T, srv *Server) (addr string, cleanup func()) {
+	t.Helper()
+
+	srv.Addr = "127.0.0.1:0"
+	if srv.Authenticator == nil {
+		srv.Authenticator = NewAnonymousAuthenticator(t.TempDir())
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(context.Background()) }()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		ln := srv.listener
+		srv.mu.Unlock()
+		if ln != nil {
+			addr = ln.Addr().String()
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if addr == "" {
+		t.Fatalf("server did not start listening")
+	}
+
+	return addr, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown() = %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("ListenAndServe() = %v", err)
+		}
+	}
+}
+
+func TestServerAcceptsConnectionAndRegistersSession(t *testing.T) {
+	srv := NewServer()
+	addr, cleanup := startTestServer(t, srv)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	if line != ServiceReadyForNewUser {
+		t.Fatalf("banner = %q, want %q", line, ServiceReadyForNewUser)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+		if n == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("session was never registered")
+}
+
+func TestServerShutdownNotifiesSessionsAndStopsAccepting(t *testing.T) {
+	srv := NewServer()
+	addr, cleanup := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil { // banner
+		t.Fatalf("read banner: %v", err)
+	}
+
+	// A well-behaved client disconnects once told the server is closing,
+	// which is what lets Shutdown's wait for in-flight sessions finish
+	// before its context deadline rather than needing a forced close.
+	notice := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		notice <- line
+		conn.Close()
+	}()
+
+	cleanup() // runs Shutdown and waits for ListenAndServe to return
+
+	if line := <-notice; line != ServiceNotAvailableClosing {
+		t.Fatalf("shutdown notice = %q, want %q", line, ServiceNotAvailableClosing)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("dial after Shutdown succeeded, want connection refused")
+	}
+}
+
+// TestServerShutdownForciblyClosesStuckSessions verifies that a session
+// which never reacts to the shutdown notice is forcibly cancelled once
+// ctx's deadline passes, rather than Shutdown blocking forever.
+func TestServerShutdownForciblyClosesStuckSessions(t *testing.T) {
+	srv := NewServer()
+	srv.Addr = "127.0.0.1:0"
+	srv.Authenticator = NewAnonymousAuthenticator(t.TempDir())
+
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- srv.ListenAndServe(context.Background()) }()
+
+	deadline := time.Now().Add(time.Second)
+	var addr string
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		ln := srv.listener
+		srv.mu.Unlock()
+		if ln != nil {
+			addr = ln.Addr().String()
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if addr == "" {
+		t.Fatalf("server did not start listening")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil { // banner
+		t.Fatalf("read banner: %v", err)
+	}
+
+	// This client never reads the shutdown notice or disconnects, so
+	// Shutdown must force it closed once its deadline passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("Shutdown() returned after %v, before its deadline", elapsed)
+	}
+
+	if err := <-listenDone; err != nil {
+		t.Errorf("ListenAndServe() = %v", err)
+	}
+}
+
+// TestServerShutdownClosesStuckDataConnections covers a session blocked in
+// io.Copy on its *data* connection rather than idling on the control
+// connection: cancelling ctx and closing the control socket (what the
+// forced-close loop used to do) never unblocks that io.Copy, so without
+// also closing the data connection Shutdown would hang past its deadline.
+func TestServerShutdownClosesStuckDataConnections(t *testing.T) {
+	srv := NewServer()
+	srv.Addr = "127.0.0.1:0"
+	srv.Authenticator = NewAnonymousAuthenticator(t.TempDir())
+
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- srv.ListenAndServe(context.Background()) }()
+
+	deadline := time.Now().Add(time.Second)
+	var addr string
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		ln := srv.listener
+		srv.mu.Unlock()
+		if ln != nil {
+			addr = ln.Addr().String()
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if addr == "" {
+		t.Fatalf("server did not start listening")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	readLine := func() string {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return line
+	}
+
+	readLine() // banner
+	fmt.Fprintf(conn, "USER anyone\r\n")
+	readLine()
+	fmt.Fprintf(conn, "PASS anything\r\n")
+	readLine()
+	fmt.Fprintf(conn, "PASV\r\n")
+	pasvResp := readLine()
+
+	open := strings.IndexByte(pasvResp, '(')
+	shut := strings.IndexByte(pasvResp, ')')
+	if open < 0 || shut < 0 {
+		t.Fatalf("PASV response = %q, want (h1,h2,h3,h4,p1,p2)", pasvResp)
+	}
+	part := strings.Split(pasvResp[open+1:shut], ",")
+	if len(part) != 6 {
+		t.Fatalf("PASV response = %q, want 6 comma-separated fields", pasvResp)
+	}
+	p1, _ := strconv.Atoi(part[4])
+	p2, _ := strconv.Atoi(part[5])
+	port := p1*256 + p2
+
+	dataConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial data conn: %v", err)
+	}
+	defer dataConn.Close()
+
+	fmt.Fprintf(conn, "STOR stuck.txt\r\n")
+	readLine() // 150 Accepted data connection
+
+	// The data socket is left open with nothing sent and nothing read, so
+	// the session's handleStore is blocked in io.Copy indefinitely.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown() took %v, want close to its 200ms deadline", elapsed)
+	}
+
+	if err := <-listenDone; err != nil {
+		t.Errorf("ListenAndServe() = %v", err)
+	}
+}
+
+func TestMetricsServeHTTPReportsCounters(t *testing.T) {
+	m := newMetrics()
+	m.addBytesIn(100)
+	m.addBytesOut(200)
+	m.addActiveSessions(1)
+	m.countCommand("RETR")
+	m.countCommand("RETR")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"ftp_bytes_in_total 100",
+		"ftp_bytes_out_total 200",
+		"ftp_active_sessions 1",
+		`ftp_commands_total{verb="RETR"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics output missing %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestNilMetricsMethodsAreNoOps(t *testing.T) {
+	var m *metrics
+	m.addBytesIn(1)
+	m.addBytesOut(1)
+	m.addActiveSessions(1)
+	m.countCommand("RETR")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// loadTLSConfig builds the server-wide *tls.Config used to upgrade control
+// and data connections when a client sends AUTH TLS. It returns a nil
+// config (explicit FTPS disabled, AUTH TLS replies with an error) when no
+// certificate was configured at startup.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// handleAuth implements RFC 4217 AUTH TLS, upgrading the control connection
+// in place to TLS. Subsequent commands on this session are read from and
+// written to the TLS conn transparently, since s.sess is just a net.Conn.
+func (s *session) handleAuth(arg []string) {
+	if len(arg) != 2 || strings.ToUpper(arg[1]) != "TLS" {
+		s.handleResponse(fmt.Sprintf(CommandNotImplemented, "AUTH"))
+		return
+	}
+
+	if s.tlsConfig == nil {
+		s.handleResponse(TLSNotAvailable)
+		return
+	}
+
+	s.handleResponse(AuthCommandSuccessful)
+
+	conn := tls.Server(s.sess, s.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.sess = conn
+}
+
+// handleFeat implements FEAT, advertising the optional commands this
+// server supports. AUTH TLS/PBSZ/PROT are only listed when s.tlsConfig is
+// set, so a client never sees FTPS advertised only to have AUTH TLS fail
+// with TLSNotAvailable.
+func (s *session) handleFeat() {
+	tlsFeatures := ""
+	if s.tlsConfig != nil {
+		tlsFeatures = " AUTH TLS\n PBSZ\n PROT\n"
+	}
+
+	s.handleResponse(fmt.Sprintf(SystemStatus, tlsFeatures))
+}
+
+// handlePBSZ implements RFC 4217 PBSZ, which is only meaningful for
+// protocols with a protection buffer size; under TLS it is always 0.
+func (s *session) handlePBSZ(arg []string) {
+	if len(arg) != 2 || arg[1] != "0" {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PBSZ"))
+		return
+	}
+
+	s.handleResponse(PbszCommandSuccessful)
+}
+
+// handleProt implements RFC 4217 PROT, selecting whether data connections
+// opened after this point are sent in the clear ("C") or wrapped in TLS
+// ("P"). PROT P is rejected until the control connection has upgraded via
+// AUTH TLS, so a client can never be left believing a transfer is private
+// when it isn't.
+func (s *session) handleProt(arg []string) {
+	if len(arg) != 2 {
+		s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PROT"))
+		return
+	}
+
+	level := strings.ToUpper(arg[1])
+	if level != "C" && level != "P" {
+		s.handleResponse(fmt.Sprintf(CommandNotImplemented, "PROT"))
+		return
+	}
+
+	if level == "P" {
+		if _, ok := s.sess.(*tls.Conn); !ok {
+			s.handleResponse(fmt.Sprintf(RequestedActionHasFailed, "PROT"))
+			return
+		}
+	}
+
+	s.prot = level
+	s.handleResponse(ProtCommandSuccessful)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedConfig returns a *tls.Config backed by a freshly generated,
+// self-signed certificate, standing in for what loadTLSConfig would return
+// from -tls-cert/-tls-key in a real deployment.
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestAuthTLSUpgradesControlConnection(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+	s.tlsConfig = selfSignedConfig(t)
+
+	done := make(chan struct{})
+	go func() {
+		s.handleAuth([]string{"AUTH", "TLS"})
+		close(done)
+	}()
+
+	assertResponse(t, client, AuthCommandSuccessful)
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	<-done
+
+	if _, ok := s.sess.(*tls.Conn); !ok {
+		t.Fatal("expected s.sess to be upgraded to *tls.Conn")
+	}
+}
+
+func TestAuthTLSWithoutConfiguredCertFails(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.handleAuth([]string{"AUTH", "TLS"})
+	assertResponse(t, client, TLSNotAvailable)
+
+	if _, ok := s.sess.(*tls.Conn); ok {
+		t.Fatal("did not expect s.sess to be upgraded without a tls config")
+	}
+}
+
+func TestHandleFeatOmitsTLSFeaturesWithoutConfiguredCert(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.handleFeat()
+	assertResponse(t, client, fmt.Sprintf(SystemStatus, ""))
+}
+
+func TestHandleFeatAdvertisesTLSFeaturesWhenConfigured(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+	s.tlsConfig = selfSignedConfig(t)
+
+	s.handleFeat()
+	assertResponse(t, client, fmt.Sprintf(SystemStatus, " AUTH TLS\n PBSZ\n PROT\n"))
+}
+
+func TestProtPRequiresTLS(t *testing.T) {
+	s, client, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+
+	s.handleProt([]string{"PROT", "P"})
+	assertResponse(t, client, fmt.Sprintf(RequestedActionHasFailed, "PROT"))
+
+	if s.prot == "P" {
+		t.Fatal("PROT P should be rejected before AUTH TLS")
+	}
+}
+
+func TestOpenDataConnWrapsTLSUnderProtP(t *testing.T) {
+	s, _, cleanup := loopback(t, "tcp4")
+	defer cleanup()
+	s.tlsConfig = selfSignedConfig(t)
+	s.prot = "P"
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	s.pasv = ln
+
+	go func() {
+		client, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		tlsClient.Handshake()
+		tlsClient.Close()
+	}()
+
+	conn, err := s.openDataConn()
+	if err != nil {
+		t.Fatalf("openDataConn: %v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Fatal("expected data connection to be wrapped in TLS under PROT P")
+	}
+}